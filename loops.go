@@ -3,19 +3,26 @@ package loops
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // Client implements the Loops API for a given API Key / endpoint.
 type Client struct {
-	apiKey   string
-	endpoint string
-	client   *http.Client
+	apiKey      string
+	endpoint    string
+	client      *http.Client
+	retry       *RetryConfig
+	rateLimiter RateLimiter
 }
 
 // DefaultEndpoint is the default endpoint used for the Loops API.
@@ -23,7 +30,6 @@ const DefaultEndpoint = "https://app.loops.so/api/v1"
 
 // NewClient creates a new Client object.
 func NewClient(apiKey string) *Client {
-	// Could use /api-key to test the API key.
 	return &Client{
 		apiKey:   apiKey,
 		endpoint: DefaultEndpoint,
@@ -31,6 +37,18 @@ func NewClient(apiKey string) *Client {
 	}
 }
 
+// NewClientWithValidation creates a new Client object and eagerly calls
+// TestAPIKey, returning an error if apiKey is invalid. This lets
+// long-running services fail fast at startup rather than on first contact
+// write.
+func NewClientWithValidation(ctx context.Context, apiKey string) (*Client, error) {
+	c := NewClient(apiKey)
+	if _, err := c.TestAPIKey(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 // WithEndpoint attaches a non-default endpoint to the Client.
 // This is generally used with dedicated, or non-serverless deployments.
 func (c *Client) WithEndpoint(endpoint string) *Client {
@@ -45,14 +63,156 @@ func (c *Client) WithHTTPClient(client *http.Client) *Client {
 	return c
 }
 
+// RetryConfig configures automatic retries for requests that fail with a
+// 429 or 5xx response.
+type RetryConfig struct {
+	// MaxAttempts is the maximum number of attempts, including the first.
+	// A value <= 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the backoff before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the backoff between retries.
+	MaxBackoff time.Duration
+	// Jitter, if true, applies full jitter to the computed backoff
+	// (a random duration between zero and the backoff ceiling).
+	Jitter bool
+}
+
+// WithRetry enables automatic retries on the Client using cfg. Retries use
+// exponential backoff, honoring a Retry-After header given in whole seconds
+// when the response includes one (a Retry-After HTTP-date is ignored). GET and PUT requests are retried by default; POST requests
+// to /events/send and /transactional are only retried when the caller opts
+// in with AllowRetry, since they can create side effects.
+func (c *Client) WithRetry(cfg RetryConfig) *Client {
+	c.retry = &cfg
+	return c
+}
+
+// RateLimiter lets callers share a proactive rate limit (e.g. a token
+// bucket) across goroutines, so a Client stays under the Loops per-second
+// limit rather than reacting to 429s after the fact.
+type RateLimiter interface {
+	// Wait blocks until a request may proceed, or ctx is canceled.
+	Wait(ctx context.Context) error
+}
+
+// WithRateLimiter attaches a RateLimiter that Client consults before
+// issuing each request.
+func (c *Client) WithRateLimiter(rl RateLimiter) *Client {
+	c.rateLimiter = rl
+	return c
+}
+
+type allowRetryKey struct{}
+
+// AllowRetry marks ctx as permitting retries for non-idempotent requests
+// (POST /events/send and /transactional) when used with a Client
+// configured via WithRetry. GET and PUT requests are always retry-eligible
+// and don't need this.
+func AllowRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, allowRetryKey{}, true)
+}
+
+func retryAllowedFromContext(ctx context.Context) bool {
+	allow, _ := ctx.Value(allowRetryKey{}).(bool)
+	return allow
+}
+
+// APIError is returned by Client methods when Loops responds with a 4xx or
+// 5xx status. Message is populated from the standard Loops error payload
+// (`{"success":false,"message":"..."}`) when the response body is valid JSON.
+type APIError struct {
+	StatusCode int
+	Status     string
+	Message    string
+	RawBody    []byte
+
+	// retryAfter is populated from a Retry-After response header given in
+	// whole seconds, when present, for use by the retry subsystem.
+	retryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s: %s", e.Status, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.RawBody)
+}
+
+// IsRateLimited reports whether the request failed because the Loops rate
+// limit (10 req/sec) was exceeded.
+func (e *APIError) IsRateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// IsUnauthorized reports whether the request failed because the API key is
+// missing or invalid.
+func (e *APIError) IsUnauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized
+}
+
+// IsNotFound reports whether the request failed because the resource (e.g.
+// a contact) does not exist.
+func (e *APIError) IsNotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// nonIdempotentPaths are the endpoints that can create side effects, and so
+// are only retried when the caller opts in via AllowRetry.
+var nonIdempotentPaths = map[string]bool{
+	"/events/send":   true,
+	"/transactional": true,
+}
+
 func (c *Client) doRequest(ctx context.Context, method, path string, body, dst any) error {
-	var reqBody io.Reader
+	var marshalled []byte
 	if body != nil {
-		marshalled, err := json.Marshal(body)
+		var err error
+		marshalled, err = json.Marshal(body)
 		if err != nil {
 			return err
 		}
-		reqBody = bytes.NewBuffer(marshalled)
+	}
+
+	retryable := !nonIdempotentPaths[path] || retryAllowedFromContext(ctx)
+
+	attempts := 1
+	if c.retry != nil && retryable && c.retry.MaxAttempts > 1 {
+		attempts = c.retry.MaxAttempts
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepBackoff(ctx, c.retry, attempt, lastErr); err != nil {
+				return err
+			}
+		}
+
+		if c.rateLimiter != nil {
+			if err := c.rateLimiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+
+		err := c.doRequestOnce(ctx, method, path, marshalled, dst)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		if !isRetriable(err) {
+			return err
+		}
+	}
+
+	return lastErr
+}
+
+func (c *Client) doRequestOnce(ctx context.Context, method, path string, marshalled []byte, dst any) error {
+	var reqBody io.Reader
+	if marshalled != nil {
+		reqBody = bytes.NewReader(marshalled)
 	}
 
 	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, reqBody)
@@ -79,7 +239,23 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body, dst a
 
 	if resp.StatusCode >= 400 {
 		buf, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("%s: %s", resp.Status, buf)
+		apiErr := &APIError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RawBody:    buf,
+		}
+		if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+			if secs, err := strconv.Atoi(retryAfter); err == nil {
+				apiErr.retryAfter = time.Duration(secs) * time.Second
+			}
+		}
+		var payload struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(buf, &payload) == nil {
+			apiErr.Message = payload.Message
+		}
+		return apiErr
 	}
 
 	if dst != nil {
@@ -91,11 +267,52 @@ func (c *Client) doRequest(ctx context.Context, method, path string, body, dst a
 	return nil
 }
 
+func isRetriable(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	return apiErr.IsRateLimited() || apiErr.StatusCode >= 500
+}
+
+// sleepBackoff waits before the next retry attempt (1-indexed), honoring a
+// Retry-After header on lastErr when present, and returns ctx.Err() if ctx
+// is canceled before the wait completes.
+func sleepBackoff(ctx context.Context, cfg *RetryConfig, attempt int, lastErr error) error {
+	backoff := cfg.InitialBackoff << uint(attempt-1)
+	if cfg.MaxBackoff > 0 && backoff > cfg.MaxBackoff {
+		backoff = cfg.MaxBackoff
+	}
+
+	var apiErr *APIError
+	if errors.As(lastErr, &apiErr) && apiErr.retryAfter > 0 {
+		backoff = apiErr.retryAfter
+	} else if cfg.Jitter && backoff > 0 {
+		backoff = time.Duration(rand.Int63n(int64(backoff)))
+	}
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
 type CreateContactResponse struct {
 	Success bool   `json:"success"`
 	ID      string `json:"id"`
 }
 
+// reservedNestedFields are the non-scalar keys validateFields allows through
+// despite the general scalar-only rule, because Loops gives them special
+// meaning on contact create/update.
+var reservedNestedFields = map[string]bool{
+	"mailingLists": true,
+}
+
 func validateFields(
 	fields map[string]any,
 ) (map[string]any, error) {
@@ -105,6 +322,10 @@ func validateFields(
 		if k == "email" {
 			continue
 		}
+		if reservedNestedFields[k] {
+			ret[k] = v
+			continue
+		}
 		switch v.(type) {
 		case string, bool, int, time.Time:
 		default:
@@ -121,12 +342,36 @@ func (c *Client) CreateContact(
 	email string,
 	// Fields is a map of field names to values. Values can only be string, boolean, integer, or time.Time.
 	fields map[string]any,
+) (*CreateContactResponse, error) {
+	return c.createContact(ctx, email, fields, nil)
+}
+
+// CreateContactWithLists creates a new contact in Loops, subscribing or
+// unsubscribing it from mailing lists by ID. A true value subscribes the
+// contact to that list; false unsubscribes it.
+func (c *Client) CreateContactWithLists(
+	ctx context.Context,
+	email string,
+	fields map[string]any,
+	mailingLists map[string]bool,
+) (*CreateContactResponse, error) {
+	return c.createContact(ctx, email, fields, mailingLists)
+}
+
+func (c *Client) createContact(
+	ctx context.Context,
+	email string,
+	fields map[string]any,
+	mailingLists map[string]bool,
 ) (*CreateContactResponse, error) {
 	req, err := validateFields(fields)
 	if err != nil {
 		return nil, err
 	}
 	req["email"] = email
+	if mailingLists != nil {
+		req["mailingLists"] = mailingLists
+	}
 	var resp CreateContactResponse
 	if err := c.doRequest(ctx, "POST", "/contacts/create", req, &resp); err != nil {
 		return nil, err
@@ -144,12 +389,36 @@ func (c *Client) UpsertContact(
 	ctx context.Context,
 	email string,
 	fields map[string]any,
+) (*UpsertContactResponse, error) {
+	return c.upsertContact(ctx, email, fields, nil)
+}
+
+// UpsertContactWithLists updates or creates a contact in Loops, subscribing
+// or unsubscribing it from mailing lists by ID. A true value subscribes the
+// contact to that list; false unsubscribes it.
+func (c *Client) UpsertContactWithLists(
+	ctx context.Context,
+	email string,
+	fields map[string]any,
+	mailingLists map[string]bool,
+) (*UpsertContactResponse, error) {
+	return c.upsertContact(ctx, email, fields, mailingLists)
+}
+
+func (c *Client) upsertContact(
+	ctx context.Context,
+	email string,
+	fields map[string]any,
+	mailingLists map[string]bool,
 ) (*UpsertContactResponse, error) {
 	req, err := validateFields(fields)
 	if err != nil {
 		return nil, err
 	}
 	req["email"] = email
+	if mailingLists != nil {
+		req["mailingLists"] = mailingLists
+	}
 	var resp UpsertContactResponse
 	if err := c.doRequest(ctx, "PUT", "/contacts/update", req, &resp); err != nil {
 		return nil, err
@@ -201,6 +470,30 @@ type SendTransactionalRequest struct {
 	Email           string         `json:"email"`
 	TransactionalID string         `json:"transactionalId"`
 	DataVariables   map[string]any `json:"dataVariables"`
+	Attachments     []Attachment   `json:"attachments,omitempty"`
+}
+
+// Attachment is a file attached to a transactional Loop. Data is the
+// base64-encoded file content, as required by the Loops transactional API.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Data        string `json:"data"`
+}
+
+// Attach reads r in full and appends it to req as an Attachment, base64-encoding
+// its contents so callers don't have to hand-roll the encoding.
+func (req *SendTransactionalRequest) Attach(filename, contentType string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	req.Attachments = append(req.Attachments, Attachment{
+		Filename:    filename,
+		ContentType: contentType,
+		Data:        base64.StdEncoding.EncodeToString(data),
+	})
+	return nil
 }
 
 // SendTransactional sends a transactional Loop to a contact.
@@ -215,3 +508,226 @@ func (c *Client) SendTransactional(
 	}
 	return &resp, nil
 }
+
+// MailingList is a Loops mailing list that contacts can be subscribed to or
+// unsubscribed from via the mailingLists field on contact create/update.
+type MailingList struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	IsPublic bool   `json:"isPublic"`
+}
+
+// ListMailingLists returns the mailing lists configured on the Loops account,
+// so callers can discover list IDs to pass to CreateContactWithLists or
+// UpsertContactWithLists.
+func (c *Client) ListMailingLists(ctx context.Context) ([]MailingList, error) {
+	var resp []MailingList
+	if err := c.doRequest(ctx, "GET", "/lists", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// contactKnownFields are the Contact keys decoded into typed fields; any
+// other key in the response is collected into Contact.Fields instead.
+var contactKnownFields = map[string]bool{
+	"id": true, "email": true, "firstName": true, "lastName": true,
+	"subscribed": true, "userGroup": true, "userId": true, "createdAt": true,
+	"mailingLists": true,
+}
+
+// Contact is a Loops contact, as returned by FindContact and ListContacts.
+// Custom properties not covered by the typed fields are decoded into Fields.
+type Contact struct {
+	ID           string
+	Email        string
+	FirstName    string
+	LastName     string
+	Subscribed   bool
+	UserGroup    string
+	UserID       string
+	CreatedAt    time.Time
+	MailingLists map[string]bool
+	Fields       map[string]any
+}
+
+// UnmarshalJSON decodes the known Contact fields and collects any remaining
+// custom properties into Fields.
+func (ct *Contact) UnmarshalJSON(data []byte) error {
+	var typed struct {
+		ID           string          `json:"id"`
+		Email        string          `json:"email"`
+		FirstName    string          `json:"firstName"`
+		LastName     string          `json:"lastName"`
+		Subscribed   bool            `json:"subscribed"`
+		UserGroup    string          `json:"userGroup"`
+		UserID       string          `json:"userId"`
+		CreatedAt    time.Time       `json:"createdAt"`
+		MailingLists map[string]bool `json:"mailingLists"`
+	}
+	if err := json.Unmarshal(data, &typed); err != nil {
+		return err
+	}
+	ct.ID = typed.ID
+	ct.Email = typed.Email
+	ct.FirstName = typed.FirstName
+	ct.LastName = typed.LastName
+	ct.Subscribed = typed.Subscribed
+	ct.UserGroup = typed.UserGroup
+	ct.UserID = typed.UserID
+	ct.CreatedAt = typed.CreatedAt
+	ct.MailingLists = typed.MailingLists
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	fields := make(map[string]any, len(raw))
+	for k, v := range raw {
+		if contactKnownFields[k] {
+			continue
+		}
+		var val any
+		if err := json.Unmarshal(v, &val); err != nil {
+			return err
+		}
+		fields[k] = val
+	}
+	ct.Fields = fields
+	return nil
+}
+
+// FindContactParams selects the contact to look up. Exactly one of Email or
+// UserID is normally set.
+type FindContactParams struct {
+	Email  string
+	UserID string
+}
+
+// FindContact looks up a contact by email or user ID.
+func (c *Client) FindContact(ctx context.Context, params FindContactParams) ([]Contact, error) {
+	q := url.Values{}
+	if params.Email != "" {
+		q.Set("email", params.Email)
+	}
+	if params.UserID != "" {
+		q.Set("userId", params.UserID)
+	}
+	path := "/contacts/find"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var resp []Contact
+	if err := c.doRequest(ctx, "GET", path, nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ListContactsOptions configures pagination for ListContacts.
+type ListContactsOptions struct {
+	// PerPage caps the number of contacts fetched per underlying request.
+	// Zero uses the Loops default.
+	PerPage int
+}
+
+type contactsPage struct {
+	Data       []Contact `json:"data"`
+	Pagination struct {
+		NextCursor string `json:"nextCursor"`
+	} `json:"pagination"`
+}
+
+// ContactIterator streams contacts from ListContacts, transparently fetching
+// further pages as needed so callers can walk large contact bases without
+// loading them all into memory at once.
+type ContactIterator struct {
+	client *Client
+	opts   ListContactsOptions
+
+	buf    []Contact
+	idx    int
+	cursor string
+	done   bool
+	err    error
+}
+
+// ListContacts returns an iterator over all contacts in the Loops account.
+func (c *Client) ListContacts(ctx context.Context, opts ListContactsOptions) *ContactIterator {
+	return &ContactIterator{client: c, opts: opts, idx: -1}
+}
+
+// Next advances the iterator and reports whether a contact is available.
+// It returns false at the end of the list or on error; check Err to tell
+// the two apart.
+func (it *ContactIterator) Next(ctx context.Context) bool {
+	if it.err != nil {
+		return false
+	}
+	it.idx++
+	for it.idx >= len(it.buf) {
+		if it.done {
+			return false
+		}
+		if err := it.fetch(ctx); err != nil {
+			it.err = err
+			return false
+		}
+		it.idx = 0
+	}
+	return true
+}
+
+func (it *ContactIterator) fetch(ctx context.Context) error {
+	q := url.Values{}
+	if it.opts.PerPage > 0 {
+		q.Set("perPage", strconv.Itoa(it.opts.PerPage))
+	}
+	if it.cursor != "" {
+		q.Set("cursor", it.cursor)
+	}
+	path := "/contacts"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	var page contactsPage
+	if err := it.client.doRequest(ctx, "GET", path, nil, &page); err != nil {
+		return err
+	}
+	it.buf = page.Data
+	if page.Pagination.NextCursor == "" {
+		it.done = true
+	} else {
+		it.cursor = page.Pagination.NextCursor
+	}
+	return nil
+}
+
+// Contact returns the contact at the iterator's current position. It's only
+// valid after a call to Next that returned true.
+func (it *ContactIterator) Contact() Contact {
+	return it.buf[it.idx]
+}
+
+// Err returns the first error encountered during iteration, if any.
+func (it *ContactIterator) Err() error {
+	return it.err
+}
+
+// APIKeyInfo describes the API key a Client is configured with, as reported
+// by Loops.
+type APIKeyInfo struct {
+	Success  bool   `json:"success"`
+	TeamName string `json:"teamName"`
+}
+
+// TestAPIKey validates the Client's API key against Loops and returns the
+// team it belongs to. It's useful for dashboards that want to surface which
+// team a key belongs to, or for failing fast at startup.
+func (c *Client) TestAPIKey(ctx context.Context) (*APIKeyInfo, error) {
+	var resp APIKeyInfo
+	if err := c.doRequest(ctx, "GET", "/api-key", nil, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}